@@ -0,0 +1,169 @@
+// Package resize implements image resampling for the imagecompress
+// tools. It is kept separate from smallbasis so that it can also be
+// used on an already-decompressed image, e.g. to upscale a
+// thumbnail for display.
+package resize
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// lanczosA is the window size (the number of lobes on either side
+// of the kernel's center) used by Lanczos3.
+const lanczosA = 3.0
+
+// Lanczos3 resamples src to exactly width x height using a
+// separable Lanczos kernel with a 3-pixel window. It is a much
+// better general-purpose resampler than nearest-neighbor, which
+// matters here since the block-basis compressor already discards
+// high-frequency detail and a poor resize compounds the artifacts.
+func Lanczos3(src image.Image, width, height int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	buf := make([]pixel, srcW*srcH)
+	for y := 0; y < srcH; y++ {
+		for x := 0; x < srcW; x++ {
+			buf[y*srcW+x] = pixelAt(src, bounds.Min.X+x, bounds.Min.Y+y)
+		}
+	}
+
+	xAxis := axisWeights(srcW, width)
+	yAxis := axisWeights(srcH, height)
+
+	// Horizontal pass: srcW x srcH -> width x srcH.
+	horiz := make([]pixel, width*srcH)
+	for y := 0; y < srcH; y++ {
+		row := buf[y*srcW : y*srcW+srcW]
+		for x := 0; x < width; x++ {
+			horiz[y*width+x] = weightedSum(row, xAxis[x])
+		}
+	}
+
+	// Vertical pass: width x srcH -> width x height.
+	res := image.NewRGBA(image.Rect(0, 0, width, height))
+	col := make([]pixel, srcH)
+	for x := 0; x < width; x++ {
+		for y := 0; y < srcH; y++ {
+			col[y] = horiz[y*width+x]
+		}
+		for y := 0; y < height; y++ {
+			res.Set(x, y, col2RGBA(weightedSum(col, yAxis[y])))
+		}
+	}
+
+	return res
+}
+
+// A pixel holds normalized (0 to 1) RGBA samples.
+type pixel [4]float64
+
+func pixelAt(img image.Image, x, y int) pixel {
+	r, g, b, a := img.At(x, y).RGBA()
+	return pixel{
+		float64(r) / 0xffff,
+		float64(g) / 0xffff,
+		float64(b) / 0xffff,
+		float64(a) / 0xffff,
+	}
+}
+
+func col2RGBA(p pixel) color.RGBA {
+	return color.RGBA{
+		R: clampByte(p[0]),
+		G: clampByte(p[1]),
+		B: clampByte(p[2]),
+		A: clampByte(p[3]),
+	}
+}
+
+func clampByte(v float64) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 0xff
+	}
+	return uint8(v*0xff + 0.5)
+}
+
+// A tap is one source pixel's contribution to an output pixel.
+type tap struct {
+	idx    int
+	weight float64
+}
+
+// axisWeights precomputes, for every output index along an axis of
+// length dstSize resampled from srcSize, the source taps and
+// normalized weights that make up that output pixel. Doing this
+// once per axis (rather than per row/column) is what makes the
+// separable convolution fast.
+func axisWeights(srcSize, dstSize int) [][]tap {
+	scale := float64(srcSize) / float64(dstSize)
+
+	// When downsampling, widen the kernel so every source pixel
+	// still contributes to some output pixel (otherwise we'd just
+	// be decimating, not filtering).
+	filterScale := math.Max(scale, 1)
+	support := lanczosA * filterScale
+
+	axis := make([][]tap, dstSize)
+	for i := range axis {
+		center := (float64(i)+0.5)*scale - 0.5
+		start := int(math.Floor(center - support))
+		end := int(math.Ceil(center + support))
+
+		var taps []tap
+		var sum float64
+		for s := start; s <= end; s++ {
+			w := lanczosKernel((float64(s) - center) / filterScale)
+			if w == 0 {
+				continue
+			}
+			taps = append(taps, tap{idx: clampInt(s, 0, srcSize-1), weight: w})
+			sum += w
+		}
+		if sum != 0 {
+			for k := range taps {
+				taps[k].weight /= sum
+			}
+		}
+		axis[i] = taps
+	}
+	return axis
+}
+
+func weightedSum(src []pixel, taps []tap) pixel {
+	var res pixel
+	for _, t := range taps {
+		s := src[t.idx]
+		for c := 0; c < 4; c++ {
+			res[c] += s[c] * t.weight
+		}
+	}
+	return res
+}
+
+// lanczosKernel evaluates the Lanczos window function with a = 3.
+func lanczosKernel(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	if x <= -lanczosA || x >= lanczosA {
+		return 0
+	}
+	piX := math.Pi * x
+	return lanczosA * math.Sin(piX) * math.Sin(piX/lanczosA) / (piX * piX)
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
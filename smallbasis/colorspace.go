@@ -0,0 +1,236 @@
+package smallbasis
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// A ColorSpace controls how a Compressor turns image pixels into
+// the planes that get split into blocks and compressed.
+type ColorSpace int
+
+const (
+	// ColorSpaceRGB compresses the red, green, and blue channels
+	// independently, exactly as the original Compressor did.
+	ColorSpaceRGB ColorSpace = iota
+
+	// ColorSpaceYCbCr444 converts pixels to Y'CbCr but keeps all
+	// three planes at full resolution.
+	ColorSpaceYCbCr444
+
+	// ColorSpaceYCbCr422 converts pixels to Y'CbCr and halves the
+	// horizontal resolution of the Cb and Cr planes.
+	ColorSpaceYCbCr422
+
+	// ColorSpaceYCbCr420 converts pixels to Y'CbCr and halves both
+	// the horizontal and vertical resolution of the Cb and Cr planes.
+	ColorSpaceYCbCr420
+)
+
+// chromaSubsampling returns the horizontal and vertical downsampling
+// factors applied to the Cb and Cr planes for cs.
+// The luma plane always uses a factor of 1.
+func (cs ColorSpace) chromaSubsampling() (x, y int) {
+	switch cs {
+	case ColorSpaceYCbCr422:
+		return 2, 1
+	case ColorSpaceYCbCr420:
+		return 2, 2
+	default:
+		return 1, 1
+	}
+}
+
+// numPlanes is always 3: either R, G, B or Y, Cb, Cr.
+func (cs ColorSpace) numPlanes() int {
+	return 3
+}
+
+// A planeData is a single-channel image, stored as a row-major
+// slice of samples in the range [0, 1].
+type planeData struct {
+	Width  int
+	Height int
+	Pixels []float64
+}
+
+func newPlaneData(w, h int) *planeData {
+	return &planeData{Width: w, Height: h, Pixels: make([]float64, w*h)}
+}
+
+func (p *planeData) at(x, y int) float64 {
+	return p.Pixels[y*p.Width+x]
+}
+
+func (p *planeData) set(x, y int, v float64) {
+	p.Pixels[y*p.Width+x] = v
+}
+
+// extractPlanes converts img into the planes that should be
+// compressed, according to cs.
+func extractPlanes(img image.Image, cs ColorSpace) []*planeData {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	planes := make([]*planeData, 3)
+	for i := range planes {
+		planes[i] = newPlaneData(w, h)
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			px := img.At(bounds.Min.X+x, bounds.Min.Y+y)
+			r, g, b, _ := px.RGBA()
+			rf := float64(r) / 0xffff
+			gf := float64(g) / 0xffff
+			bf := float64(b) / 0xffff
+
+			if cs == ColorSpaceRGB {
+				planes[0].set(x, y, rf)
+				planes[1].set(x, y, gf)
+				planes[2].set(x, y, bf)
+			} else {
+				yy, cb, cr := rgbToYCbCr(rf, gf, bf)
+				planes[0].set(x, y, yy)
+				planes[1].set(x, y, cb)
+				planes[2].set(x, y, cr)
+			}
+		}
+	}
+
+	if cs != ColorSpaceRGB {
+		xFactor, yFactor := cs.chromaSubsampling()
+		planes[1] = downsampleBox(planes[1], xFactor, yFactor)
+		planes[2] = downsampleBox(planes[2], xFactor, yFactor)
+	}
+
+	return planes
+}
+
+// combinePlanes reverses extractPlanes, turning the (possibly
+// subsampled) planes back into a full-resolution RGBA image.
+func combinePlanes(w, h int, planes []*planeData, cs ColorSpace) image.Image {
+	if cs != ColorSpaceRGB {
+		planes[1] = upsampleBilinear(planes[1], w, h)
+		planes[2] = upsampleBilinear(planes[2], w, h)
+	}
+
+	res := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var rf, gf, bf float64
+			if cs == ColorSpaceRGB {
+				rf = planes[0].at(x, y)
+				gf = planes[1].at(x, y)
+				bf = planes[2].at(x, y)
+			} else {
+				rf, gf, bf = yCbCrToRGB(planes[0].at(x, y), planes[1].at(x, y), planes[2].at(x, y))
+			}
+			res.Set(x, y, color.RGBA{
+				R: clampByte(rf),
+				G: clampByte(gf),
+				B: clampByte(bf),
+				A: 0xff,
+			})
+		}
+	}
+	return res
+}
+
+func clampByte(v float64) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 0xff
+	}
+	return uint8(v*0xff + 0.5)
+}
+
+// rgbToYCbCr implements the ITU-R BT.601 transform used by JPEG,
+// with inputs and outputs in the range [0, 1].
+func rgbToYCbCr(r, g, b float64) (y, cb, cr float64) {
+	y = 0.299*r + 0.587*g + 0.114*b
+	cb = -0.168736*r - 0.331264*g + 0.5*b + 0.5
+	cr = 0.5*r - 0.418688*g - 0.081312*b + 0.5
+	return
+}
+
+// yCbCrToRGB is the inverse of rgbToYCbCr.
+func yCbCrToRGB(y, cb, cr float64) (r, g, b float64) {
+	cb -= 0.5
+	cr -= 0.5
+	r = y + 1.402*cr
+	g = y - 0.344136*cb - 0.714136*cr
+	b = y + 1.772*cb
+	return
+}
+
+// downsampleBox shrinks p by xFactor horizontally and yFactor
+// vertically, averaging each block of source samples into one
+// output sample.
+func downsampleBox(p *planeData, xFactor, yFactor int) *planeData {
+	if xFactor == 1 && yFactor == 1 {
+		return p
+	}
+	outW := ceilDiv(p.Width, xFactor)
+	outH := ceilDiv(p.Height, yFactor)
+	res := newPlaneData(outW, outH)
+	for oy := 0; oy < outH; oy++ {
+		for ox := 0; ox < outW; ox++ {
+			var sum float64
+			var count int
+			for sy := oy * yFactor; sy < oy*yFactor+yFactor && sy < p.Height; sy++ {
+				for sx := ox * xFactor; sx < ox*xFactor+xFactor && sx < p.Width; sx++ {
+					sum += p.at(sx, sy)
+					count++
+				}
+			}
+			res.set(ox, oy, sum/float64(count))
+		}
+	}
+	return res
+}
+
+// upsampleBilinear grows p to an outW x outH plane using bilinear
+// interpolation between source samples.
+func upsampleBilinear(p *planeData, outW, outH int) *planeData {
+	if p.Width == outW && p.Height == outH {
+		return p
+	}
+	res := newPlaneData(outW, outH)
+	xScale := float64(p.Width) / float64(outW)
+	yScale := float64(p.Height) / float64(outH)
+	for oy := 0; oy < outH; oy++ {
+		srcY := (float64(oy)+0.5)*yScale - 0.5
+		y0 := clampInt(int(math.Floor(srcY)), 0, p.Height-1)
+		y1 := clampInt(y0+1, 0, p.Height-1)
+		yFrac := srcY - math.Floor(srcY)
+		for ox := 0; ox < outW; ox++ {
+			srcX := (float64(ox)+0.5)*xScale - 0.5
+			x0 := clampInt(int(math.Floor(srcX)), 0, p.Width-1)
+			x1 := clampInt(x0+1, 0, p.Width-1)
+			xFrac := srcX - math.Floor(srcX)
+
+			top := p.at(x0, y0)*(1-xFrac) + p.at(x1, y0)*xFrac
+			bottom := p.at(x0, y1)*(1-xFrac) + p.at(x1, y1)*xFrac
+			res.set(ox, oy, top*(1-yFrac)+bottom*yFrac)
+		}
+	}
+	return res
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
@@ -1,9 +1,8 @@
 package smallbasis
 
 import (
-	"errors"
+	"bytes"
 	"image"
-	"image/color"
 	"math"
 	"sort"
 
@@ -23,6 +22,30 @@ type Compressor struct {
 	basisLU *ludecomp.LU
 
 	blockSize int
+
+	// ColorSpace controls whether the image is compressed as
+	// independent R, G, B planes (the default, ColorSpaceRGB)
+	// or as Y'CbCr with optional chroma subsampling.
+	ColorSpace ColorSpace
+
+	// ChromaQuality overrides quality for the Cb and Cr planes
+	// when ColorSpace is not ColorSpaceRGB. Since the eye is
+	// much less sensitive to chroma detail than luma detail,
+	// this is typically set lower than quality. If it is zero,
+	// it defaults to half of quality.
+	ChromaQuality float64
+
+	// Parallelism is the number of goroutines used to compress
+	// blocks. If it is zero, runtime.NumCPU() is used instead.
+	// Decompress does not use it: blocks are decoded one at a
+	// time on the calling goroutine.
+	Parallelism int
+
+	// AutoOrient controls how CompressReader handles the EXIF
+	// orientation tag; see CompressReader's documentation. It has
+	// no effect on Compress, which only ever sees a decoded
+	// image.Image and so has no EXIF data to read.
+	AutoOrient bool
 }
 
 // NewCompressorBasis creates a Compressor that uses a custom
@@ -65,75 +88,119 @@ func NewCompressor(quality float64) *Compressor {
 	return NewCompressorBlockSize(quality, DefaultBlockSize)
 }
 
+// chromaQuality returns the quality used for the Cb and Cr
+// planes when c.ColorSpace is not ColorSpaceRGB.
+func (c *Compressor) chromaQuality() float64 {
+	if c.ChromaQuality != 0 {
+		return c.ChromaQuality
+	}
+	return c.quality / 2
+}
+
 // Compress compresses an image and returns binary data
-// representing the result.
+// representing the result. It is a thin wrapper around encodeTo,
+// the same streaming machinery NewEncoder uses, buffered into a
+// []byte for callers who don't need to stream it themselves.
 func (c *Compressor) Compress(i image.Image) []byte {
-	blocks := c.blocksInImage(i)
+	var buf bytes.Buffer
+	_ = c.encodeTo(&buf, i, OrientationNormal)
+	return buf.Bytes()
+}
+
+// compressImage is the shared implementation behind Compress and
+// CompressReader; orientation is recorded in the compressed header
+// as-is, without being validated or applied.
+func (c *Compressor) compressImage(i image.Image, orientation Orientation) *compressedImage {
+	planes := extractPlanes(i, c.ColorSpace)
+
+	compressed := &compressedImage{
+		ColorSpace:  c.ColorSpace,
+		BlockSize:   c.blockSize,
+		Width:       i.Bounds().Dx(),
+		Height:      i.Bounds().Dy(),
+		Orientation: orientation,
+		Planes:      make([]*compressedPlane, len(planes)),
+	}
+
+	for planeIdx, plane := range planes {
+		quality := c.quality
+		if c.ColorSpace != ColorSpaceRGB && planeIdx > 0 {
+			quality = c.chromaQuality()
+		}
+		compressed.Planes[planeIdx] = c.compressPlane(plane, quality)
+	}
+
+	return compressed
+}
+
+// compressPlane runs the basis-projection pipeline (the same one
+// the original single-plane Compress used) on a single color
+// plane, using quality to decide how many basis vectors to keep.
+func (c *Compressor) compressPlane(plane *planeData, quality float64) *compressedPlane {
+	blocks := c.blocksInPlane(plane)
+
 	r := &RankedVectors{
 		BasisIndices: make([]int, c.blockSize*c.blockSize),
-		CoeffTotal:   make([]float64, c.blockSize*c.blockSize),
+		CoeffTotal:   c.coeffTotals(blocks),
 	}
 	for i := range r.BasisIndices {
 		r.BasisIndices[i] = i
 	}
-	for _, block := range blocks {
-		solution := c.basisLU.Solve(block)
-		for i, coeff := range solution {
-			r.CoeffTotal[i] += math.Abs(coeff)
-		}
-	}
 
 	sort.Sort(r)
-	basisCount := roundFloat(c.quality * float64(c.blockSize*c.blockSize))
+	basisCount := roundFloat(quality * float64(c.blockSize*c.blockSize))
+
+	// usedBasis is kept in energy rank order (highest CoeffTotal
+	// first), not resorted by basis index: quantizeBlock/
+	// dequantizeBlock index their per-coefficient quant step by
+	// position in this list, and that step should get finer as
+	// energy rank improves, regardless of which raw basis index
+	// happens to carry that energy (e.g. BasisMatrix's all-ones DC
+	// column is usually the single highest-energy term, but it
+	// isn't index 0).
 	usedBasis := make([]int, basisCount)
 	copy(usedBasis, r.BasisIndices)
-	sort.Ints(usedBasis)
 
 	basisVectors := c.basisVectors(usedBasis)
 
-	projBlocks := c.projectionBlocks(basisVectors, blocks)
-
-	compressed := &compressedImage{
+	return &compressedPlane{
+		Width:     plane.Width,
+		Height:    plane.Height,
+		Quality:   quality,
 		UsedBasis: usedBasis,
-		Blocks:    projBlocks,
-		BlockSize: c.blockSize,
-		Width:     i.Bounds().Dx(),
-		Height:    i.Bounds().Dy(),
+		Blocks:    c.projectionBlocks(basisVectors, blocks),
 	}
-	return compressed.Encode()
+}
+
+// coeffTotals computes, for every basis vector, the sum of the
+// absolute value of its coefficient across every block. Each
+// basisLU.Solve call is independent, so the blocks are sharded
+// across c.workerCount() goroutines and the per-worker partial
+// sums (an associative reduction) are added together at the end.
+func (c *Compressor) coeffTotals(blocks []linalg.Vector) []float64 {
+	width := c.blockSize * c.blockSize
+	return parallelSum(len(blocks), c.workerCount(), width, func(start, end int, local []float64) {
+		for _, block := range blocks[start:end] {
+			solution := c.basisLU.Solve(block)
+			for i, coeff := range solution {
+				local[i] += math.Abs(coeff)
+			}
+		}
+	})
 }
 
 // Decompress decodes the binary data of a compressed image,
-// turning it back into a usable image.
+// turning it back into a usable image. It is a thin wrapper around
+// the same Decoder a caller streaming from an io.Reader would use
+// directly via NewDecoder, except that it reuses c's own basis so
+// that images compressed with a custom basis (via NewCompressorBasis)
+// decode correctly.
 func (c *Compressor) Decompress(d []byte) (image.Image, error) {
-	ci, err := decodeCompressedImage(d, c.blockSize)
+	dec, err := newDecoder(bytes.NewReader(d), c)
 	if err != nil {
 		return nil, err
 	}
-
-	// decodeCompressedImage does not verify the basis list.
-	// We must verify the basis to prevent a possible panic().
-	if !sort.IntsAreSorted(ci.UsedBasis) {
-		return nil, errors.New("unsorted basis vectors in decoded image")
-	}
-	for _, x := range ci.UsedBasis {
-		if x >= c.basis.Rows || x < 0 {
-			return nil, errors.New("overflowing basis vectors in decoded image")
-		}
-	}
-
-	basisVectors := c.basisVectors(ci.UsedBasis)
-
-	blocks := make([][]float64, len(ci.Blocks))
-	for i, encodedBlock := range ci.Blocks {
-		if len(basisVectors) > 0 {
-			blocks[i] = linearCombination(basisVectors, encodedBlock)
-		} else {
-			blocks[i] = make([]float64, c.blockSize*c.blockSize)
-		}
-	}
-
-	return c.blocksToImage(ci.Width, ci.Height, blocks), nil
+	return dec.Decode()
 }
 
 func (c *Compressor) basisVectors(indices []int) []linalg.Vector {
@@ -172,7 +239,8 @@ func (c *Compressor) projectionBlocks(basis, blocks []linalg.Vector) [][]float64
 	projLeftLU := cholesky.Decompose(projLeft)
 
 	res := make([][]float64, len(blocks))
-	for i, block := range blocks {
+	parallelRange(len(blocks), c.workerCount(), func(i int) {
+		block := blocks[i]
 		// blockDot corresponds to (A^T)b in the explanation above.
 		blockDot := make(linalg.Vector, len(basis))
 		for k := range blockDot {
@@ -180,106 +248,85 @@ func (c *Compressor) projectionBlocks(basis, blocks []linalg.Vector) [][]float64
 		}
 		solution := projLeftLU.Solve(blockDot)
 		res[i] = []float64(solution)
-	}
+	})
 
 	return res
 }
 
-func (c *Compressor) blocksInImage(i image.Image) []linalg.Vector {
-	numRows, numCols := c.blockCounts(i.Bounds())
-
-	res := make([]linalg.Vector, 0, 3*numRows*numCols)
-	for row := 0; row < numRows; row++ {
-		for col := 0; col < numCols; col++ {
-			startX := i.Bounds().Min.X + col*c.blockSize
-			startY := i.Bounds().Min.Y + row*c.blockSize
-			blocks := make([]linalg.Vector, 3)
-			for i := range blocks {
-				blocks[i] = make(linalg.Vector, c.blockSize*c.blockSize)
-			}
-			for y := 0; y < c.blockSize; y++ {
-				if y+startY >= i.Bounds().Max.Y {
-					continue
-				}
-				for x := 0; x < c.blockSize; x++ {
-					if x+startX >= i.Bounds().Max.X {
-						continue
-					}
-					px := i.At(x+startX, y+startY)
-					r, g, b, _ := px.RGBA()
-					idx := y * c.blockSize
-					if y%2 == 0 {
-						idx += x
-					} else {
-						idx += c.blockSize - (x + 1)
-					}
-					blocks[0][idx] = float64(r) / 0xffff
-					blocks[1][idx] = float64(g) / 0xffff
-					blocks[2][idx] = float64(b) / 0xffff
-				}
+// blocksInPlane splits a single color plane into blockSize-by-
+// blockSize blocks, using the same boustrophedon pixel ordering
+// the original per-image block splitter used.
+func (c *Compressor) blocksInPlane(p *planeData) []linalg.Vector {
+	numRows, numCols := c.blockCounts(p.Width, p.Height)
+
+	res := make([]linalg.Vector, numRows*numCols)
+	parallelRange(len(res), c.workerCount(), func(i int) {
+		row, col := i/numCols, i%numCols
+		startX := col * c.blockSize
+		startY := row * c.blockSize
+		block := make(linalg.Vector, c.blockSize*c.blockSize)
+		for y := 0; y < c.blockSize; y++ {
+			if y+startY >= p.Height {
+				continue
 			}
-			res = append(res, blocks...)
-		}
-	}
-
-	return res
-}
-
-func (c *Compressor) blocksToImage(w, h int, blocks [][]float64) image.Image {
-	res := image.NewRGBA(image.Rect(0, 0, w, h))
-	rows, cols := c.blockCounts(res.Bounds())
-
-	blockIdx := 0
-	for row := 0; row < rows; row++ {
-		for col := 0; col < cols; col++ {
-			colorBlocks := blocks[blockIdx : blockIdx+3]
-			blockIdx += 3
-			for y := 0; y < c.blockSize; y++ {
-				if y+row*c.blockSize >= h {
+			for x := 0; x < c.blockSize; x++ {
+				if x+startX >= p.Width {
 					continue
 				}
-				for x := 0; x < c.blockSize; x++ {
-					if x+col*c.blockSize >= w {
-						continue
-					}
-					pxIdx := y * c.blockSize
-					if y%2 == 0 {
-						pxIdx += x
-					} else {
-						pxIdx += c.blockSize - (x + 1)
-					}
-					rVal := math.Min(math.Max(colorBlocks[0][pxIdx], 0), 1)
-					gVal := math.Min(math.Max(colorBlocks[1][pxIdx], 0), 1)
-					bVal := math.Min(math.Max(colorBlocks[2][pxIdx], 0), 1)
-					px := color.RGBA{
-						R: uint8(rVal * 0xff),
-						G: uint8(gVal * 0xff),
-						B: uint8(bVal * 0xff),
-						A: 0xff,
-					}
-					res.Set(x+col*c.blockSize, y+row*c.blockSize, px)
-				}
+				block[zigzagIndex(x, y, c.blockSize)] = p.at(x+startX, y+startY)
 			}
 		}
-	}
+		res[i] = block
+	})
 
 	return res
 }
 
-func (c *Compressor) blockCounts(bounds image.Rectangle) (rows, cols int) {
-	cols = bounds.Dx() / c.blockSize
-	if bounds.Dx()%c.blockSize != 0 {
+func (c *Compressor) blockCounts(w, h int) (rows, cols int) {
+	cols = w / c.blockSize
+	if w%c.blockSize != 0 {
 		cols++
 	}
 
-	rows = bounds.Dy() / c.blockSize
-	if bounds.Dy()%c.blockSize != 0 {
+	rows = h / c.blockSize
+	if h%c.blockSize != 0 {
 		rows++
 	}
 
 	return
 }
 
+// zigzagIndex maps a pixel at (x, y) within a blockSize-by-
+// blockSize block to its position in the block's flattened,
+// boustrophedon-ordered vector.
+func zigzagIndex(x, y, blockSize int) int {
+	idx := y * blockSize
+	if y%2 == 0 {
+		idx += x
+	} else {
+		idx += blockSize - (x + 1)
+	}
+	return idx
+}
+
+// roundFloat rounds f to the nearest integer.
+func roundFloat(f float64) int {
+	return int(math.Floor(f + 0.5))
+}
+
+// linearCombination computes the weighted sum of vectors, using
+// coeffs[i] as the weight for vectors[i].
+func linearCombination(vectors []linalg.Vector, coeffs []float64) []float64 {
+	res := make([]float64, len(vectors[0]))
+	for i, vec := range vectors {
+		coeff := coeffs[i]
+		for j, x := range vec {
+			res[j] += x * coeff
+		}
+	}
+	return res
+}
+
 type RankedVectors struct {
 	BasisIndices []int
 	CoeffTotal   []float64
@@ -0,0 +1,74 @@
+package smallbasis
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// benchImage builds a synthetic size-by-size RGBA image with enough
+// variation across blocks that compression can't shortcut on a flat
+// input; the benchmarks use 1024x1024, large enough to put a
+// meaningful number of blocks through the per-block pipeline being
+// benchmarked.
+func benchImage(size int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.Set(x, y, color.RGBA{
+				R: byte(x),
+				G: byte(y),
+				B: byte(x ^ y),
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+// BenchmarkCompressParallelism compresses a large image with a range
+// of Parallelism settings, so `go test -bench` output shows the
+// speedup (or lack of it) from the worker pool added alongside this
+// benchmark.
+func BenchmarkCompressParallelism(b *testing.B) {
+	img := benchImage(1024)
+
+	for _, p := range []int{1, 2, 4, 8} {
+		b.Run(parallelismLabel(p), func(b *testing.B) {
+			c := NewCompressor(0.5)
+			c.Parallelism = p
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Compress(img)
+			}
+		})
+	}
+}
+
+// BenchmarkDecompressParallelism mirrors BenchmarkCompressParallelism
+// for the decode side. Decompress decodes blocks sequentially and
+// does not use Parallelism, so the settings are expected to time
+// alike.
+func BenchmarkDecompressParallelism(b *testing.B) {
+	img := benchImage(1024)
+	c := NewCompressor(0.5)
+	data := c.Compress(img)
+
+	for _, p := range []int{1, 2, 4, 8} {
+		b.Run(parallelismLabel(p), func(b *testing.B) {
+			c := NewCompressor(0.5)
+			c.Parallelism = p
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Decompress(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func parallelismLabel(p int) string {
+	return fmt.Sprintf("Parallelism=%d", p)
+}
@@ -0,0 +1,243 @@
+package smallbasis
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// streamMagic and streamVersion identify the binary format written
+// by writeTo/NewEncoder and read back by newDecoder/NewDecoder. The
+// version byte lets a future format change be rejected cleanly
+// instead of silently misparsed.
+const (
+	streamMagic   = "SBC1"
+	streamVersion = 1
+)
+
+// A compressedPlane holds the pruned basis and projected
+// coefficients for a single color plane (e.g. R, G, B or
+// Y, Cb, Cr). Width and Height describe the plane itself,
+// which may be smaller than the image when chroma
+// subsampling is in effect.
+type compressedPlane struct {
+	Width  int
+	Height int
+
+	// Quality is the quality this plane was compressed at. It is
+	// stored so that Decompress can reconstruct the exact same
+	// per-coefficient quantizer steps used by Encode.
+	Quality float64
+
+	UsedBasis []int
+	Blocks    [][]float64
+}
+
+// A compressedImage is the in-memory representation of the
+// binary format written by writeTo and read by newDecoder.
+type compressedImage struct {
+	ColorSpace  ColorSpace
+	Orientation Orientation
+	BlockSize   int
+	Width       int
+	Height      int
+	Planes      []*compressedPlane
+}
+
+// errWriter wraps a *bufio.Writer and remembers the first error any
+// write encounters, so a long sequence of header/plane writes can
+// skip individual error checks and be checked once at the end.
+type errWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *errWriter) writeByte(b byte) {
+	if w.err != nil {
+		return
+	}
+	w.err = w.w.WriteByte(b)
+}
+
+func (w *errWriter) writeBytes(b []byte) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.w.Write(b)
+}
+
+func (w *errWriter) writeUint16(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	w.writeBytes(b[:])
+}
+
+func (w *errWriter) writeUint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.writeBytes(b[:])
+}
+
+func (w *errWriter) writeUint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.writeBytes(b[:])
+}
+
+// writeTo serializes ci, writing directly to bw instead of
+// building up an intermediate byte slice, so a caller streaming to
+// a socket or gzip.Writer never holds the whole encoded image in
+// memory at once. It flushes bw before returning.
+func (ci *compressedImage) writeTo(bw *bufio.Writer) error {
+	ew := &errWriter{w: bw}
+
+	ew.writeBytes([]byte(streamMagic))
+	ew.writeByte(streamVersion)
+	ew.writeByte(byte(ci.ColorSpace))
+	ew.writeByte(byte(ci.Orientation))
+	ew.writeUint32(uint32(ci.BlockSize))
+	ew.writeUint32(uint32(ci.Width))
+	ew.writeUint32(uint32(ci.Height))
+
+	for _, plane := range ci.Planes {
+		ew.writeUint32(uint32(plane.Width))
+		ew.writeUint32(uint32(plane.Height))
+		ew.writeUint64(math.Float64bits(plane.Quality))
+
+		ew.writeUint32(uint32(len(plane.UsedBasis)))
+		for _, idx := range plane.UsedBasis {
+			ew.writeUint32(uint32(idx))
+		}
+
+		ew.writeUint32(uint32(len(plane.Blocks)))
+		writeQuantizedCoefficients(ew, plane)
+	}
+
+	if ew.err != nil {
+		return ew.err
+	}
+	return bw.Flush()
+}
+
+// writeQuantizedCoefficients quantizes every coefficient in plane
+// and writes them as a run-length-and-Huffman-coded stream: a zero
+// coefficient is nearly always the common case, especially for the
+// high-frequency basis vectors that survive pruning the least. The
+// Huffman-coded bits are written straight to ew's underlying writer
+// as they're produced, one byte at a time.
+func writeQuantizedCoefficients(ew *errWriter, plane *compressedPlane) {
+	flat := make([]int16, 0, len(plane.Blocks)*len(plane.UsedBasis))
+	for _, block := range plane.Blocks {
+		flat = append(flat, quantizeBlock(block, plane.Quality)...)
+	}
+
+	symbols := rleEncode(flat)
+	lengths := huffmanLengths(symbols)
+	table := canonicalSymbolOrder(lengths)
+	codes := canonicalCodes(table, lengths)
+
+	ew.writeUint32(uint32(len(table)))
+	for _, sym := range table {
+		ew.writeUint16(sym.Run)
+		ew.writeUint16(uint16(sym.Val))
+		ew.writeByte(lengths[sym])
+	}
+	ew.writeUint32(uint32(len(symbols)))
+	if ew.err != nil {
+		return
+	}
+
+	bitW := newBitWriter(ew.w)
+	for _, sym := range symbols {
+		if err := bitW.writeBits(codes[sym]); err != nil {
+			ew.err = err
+			return
+		}
+	}
+	ew.err = bitW.flush()
+}
+
+// errReader wraps a reader implementing both io.Reader and
+// io.ByteReader (as *bufio.Reader does) and remembers the first
+// error any read encounters, mirroring errWriter.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+type errReader struct {
+	r   byteReader
+	err error
+}
+
+func (r *errReader) readByte() byte {
+	if r.err != nil {
+		return 0
+	}
+	b, err := r.r.ReadByte()
+	r.err = err
+	return b
+}
+
+func (r *errReader) readBytes(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	b := make([]byte, n)
+	_, r.err = io.ReadFull(r.r, b)
+	return b
+}
+
+func (r *errReader) readUint16() uint16 {
+	return binary.BigEndian.Uint16(r.readBytes(2))
+}
+
+func (r *errReader) readUint32() uint32 {
+	return binary.BigEndian.Uint32(r.readBytes(4))
+}
+
+func (r *errReader) readUint64() uint64 {
+	return binary.BigEndian.Uint64(r.readBytes(8))
+}
+
+// maxHuffmanTableSize is a generous sanity bound on the number of
+// distinct symbols a plane's Huffman table can declare. It isn't a
+// tight structural limit, just enough headroom for any real plane
+// while rejecting a corrupt or adversarial header before it drives
+// a multi-gigabyte allocation.
+const maxHuffmanTableSize = 1 << 20
+
+// readHuffmanTable reads the canonical Huffman table and symbol
+// count written by writeQuantizedCoefficients and returns a decode
+// tree along with the number of (run, value) symbols that follow in
+// the bitstream.
+func readHuffmanTable(er *errReader) (*decodeTree, int, error) {
+	tableSize := er.readUint32()
+	if er.err == nil && tableSize > maxHuffmanTableSize {
+		return nil, 0, errors.New("smallbasis: huffman table size exceeds sane bound")
+	}
+
+	lengths := make(map[rleSymbol]uint8, tableSize)
+	table := make([]rleSymbol, tableSize)
+	for i := range table {
+		run := er.readUint16()
+		val := er.readUint16()
+		length := er.readByte()
+		sym := rleSymbol{Run: run, Val: int16(val)}
+		table[i] = sym
+		lengths[sym] = length
+	}
+	symbolCount := er.readUint32()
+	if er.err != nil {
+		return nil, 0, errors.New("smallbasis: truncated huffman table")
+	}
+
+	var tree *decodeTree
+	if symbolCount > 0 {
+		codes := canonicalCodes(table, lengths)
+		tree = buildDecodeTree(codes)
+	}
+	return tree, int(symbolCount), nil
+}
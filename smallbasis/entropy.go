@@ -0,0 +1,341 @@
+package smallbasis
+
+import (
+	"container/heap"
+	"io"
+	"sort"
+)
+
+// An rleSymbol is the unit symbol the entropy coder works on: a
+// run of zero coefficients followed by a single nonzero value.
+// A plane's quantized coefficients are turned into a sequence of
+// these before Huffman coding, since the vast majority of
+// high-frequency (and pruned) coefficients are zero.
+type rleSymbol struct {
+	Run uint16
+	Val int16
+}
+
+// rleEncode turns a flat slice of quantized coefficients into a
+// sequence of (zero-run, value) pairs. A trailing run of zeros is
+// left implicit, since the decoder already knows how many
+// coefficients to expect.
+func rleEncode(flat []int16) []rleSymbol {
+	var res []rleSymbol
+	run := 0
+	for _, v := range flat {
+		if v == 0 {
+			run++
+			continue
+		}
+		res = append(res, rleSymbol{Run: uint16(run), Val: v})
+		run = 0
+	}
+	return res
+}
+
+// huffCode is a Huffman code: the low `Length` bits of Bits,
+// written out most-significant-bit first.
+type huffCode struct {
+	Bits   uint32
+	Length uint8
+}
+
+// huffmanLengths computes the Huffman code length for each
+// distinct symbol in symbols, using a standard frequency-sorted
+// binary merge tree.
+func huffmanLengths(symbols []rleSymbol) map[rleSymbol]uint8 {
+	freq := map[rleSymbol]int{}
+	for _, s := range symbols {
+		freq[s]++
+	}
+
+	lengths := map[rleSymbol]uint8{}
+	if len(freq) == 0 {
+		return lengths
+	}
+	if len(freq) == 1 {
+		for s := range freq {
+			lengths[s] = 1
+		}
+		return lengths
+	}
+
+	// Seed the heap in a deterministic order: ranging over freq
+	// directly would let Go's randomized map iteration order decide
+	// how equal-frequency symbols are merged, making Compress a
+	// nondeterministic function of its input. Sort by (freq, Run,
+	// Val) first, the same tie-break canonicalSymbolOrder uses.
+	keys := make([]rleSymbol, 0, len(freq))
+	for s := range freq {
+		keys = append(keys, s)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if freq[keys[i]] != freq[keys[j]] {
+			return freq[keys[i]] < freq[keys[j]]
+		}
+		if keys[i].Run != keys[j].Run {
+			return keys[i].Run < keys[j].Run
+		}
+		return keys[i].Val < keys[j].Val
+	})
+
+	pq := make(huffPQ, 0, len(freq))
+	for _, s := range keys {
+		pq = append(pq, &huffNode{sym: s, freq: freq[s], leaf: true})
+	}
+	heap.Init(&pq)
+
+	for pq.Len() > 1 {
+		a := heap.Pop(&pq).(*huffNode)
+		b := heap.Pop(&pq).(*huffNode)
+		heap.Push(&pq, &huffNode{freq: a.freq + b.freq, left: a, right: b})
+	}
+	root := heap.Pop(&pq).(*huffNode)
+	root.walk(0, lengths)
+
+	return lengths
+}
+
+type huffNode struct {
+	sym         rleSymbol
+	leaf        bool
+	freq        int
+	left, right *huffNode
+}
+
+func (n *huffNode) walk(depth uint8, lengths map[rleSymbol]uint8) {
+	if n.leaf {
+		if depth == 0 {
+			depth = 1
+		}
+		lengths[n.sym] = depth
+		return
+	}
+	n.left.walk(depth+1, lengths)
+	n.right.walk(depth+1, lengths)
+}
+
+type huffPQ []*huffNode
+
+func (p huffPQ) Len() int            { return len(p) }
+func (p huffPQ) Less(i, j int) bool  { return p[i].freq < p[j].freq }
+func (p huffPQ) Swap(i, j int)       { p[i], p[j] = p[j], p[i] }
+func (p *huffPQ) Push(x interface{}) { *p = append(*p, x.(*huffNode)) }
+func (p *huffPQ) Pop() interface{} {
+	old := *p
+	n := len(old)
+	item := old[n-1]
+	*p = old[:n-1]
+	return item
+}
+
+// canonicalSymbolOrder returns the distinct symbols in lengths,
+// ordered by (code length, Run, Val). This is the order in which
+// the symbol table is written to and read from disk, and the order
+// canonicalCodes uses to assign codes, so that the decoder can
+// rebuild identical codes from code lengths alone.
+func canonicalSymbolOrder(lengths map[rleSymbol]uint8) []rleSymbol {
+	ordered := make([]rleSymbol, 0, len(lengths))
+	for sym := range lengths {
+		ordered = append(ordered, sym)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		li, lj := lengths[ordered[i]], lengths[ordered[j]]
+		if li != lj {
+			return li < lj
+		}
+		if ordered[i].Run != ordered[j].Run {
+			return ordered[i].Run < ordered[j].Run
+		}
+		return ordered[i].Val < ordered[j].Val
+	})
+	return ordered
+}
+
+// canonicalCodes assigns canonical Huffman codes to the symbols in
+// ordered (as produced by canonicalSymbolOrder), given their code
+// lengths. Both the encoder and decoder derive codes this way, so
+// no code bits ever need to be stored on disk.
+func canonicalCodes(ordered []rleSymbol, lengths map[rleSymbol]uint8) map[rleSymbol]huffCode {
+	codes := map[rleSymbol]huffCode{}
+	var code uint32
+	var prevLen uint8
+	for i, sym := range ordered {
+		length := lengths[sym]
+		if i > 0 {
+			code <<= length - prevLen
+		}
+		codes[sym] = huffCode{Bits: code, Length: length}
+		code++
+		prevLen = length
+	}
+	return codes
+}
+
+// A bitWriter packs bits, most-significant-bit first, writing each
+// completed byte straight to the underlying writer rather than
+// buffering the whole bitstream. This lets an Encoder stream
+// coefficients to a socket or gzip.Writer as they're produced.
+type bitWriter struct {
+	w       io.ByteWriter
+	cur     byte
+	curBits uint8
+}
+
+func newBitWriter(w io.ByteWriter) *bitWriter {
+	return &bitWriter{w: w}
+}
+
+func (w *bitWriter) writeBits(c huffCode) error {
+	for i := int(c.Length) - 1; i >= 0; i-- {
+		bit := byte((c.Bits >> uint(i)) & 1)
+		w.cur = w.cur<<1 | bit
+		w.curBits++
+		if w.curBits == 8 {
+			if err := w.w.WriteByte(w.cur); err != nil {
+				return err
+			}
+			w.cur, w.curBits = 0, 0
+		}
+	}
+	return nil
+}
+
+// flush pads and writes out any partial final byte. It must be
+// called once after the last writeBits call.
+func (w *bitWriter) flush() error {
+	if w.curBits > 0 {
+		err := w.w.WriteByte(w.cur << (8 - w.curBits))
+		w.cur, w.curBits = 0, 0
+		return err
+	}
+	return nil
+}
+
+// A bitReader reads bits written by a bitWriter, pulling bytes from
+// the underlying reader lazily instead of requiring the whole
+// bitstream up front.
+type bitReader struct {
+	r        io.ByteReader
+	cur      byte
+	bitsLeft uint8
+}
+
+func newBitReader(r io.ByteReader) *bitReader {
+	return &bitReader{r: r}
+}
+
+func (r *bitReader) readBit() uint32 {
+	if r.bitsLeft == 0 {
+		b, err := r.r.ReadByte()
+		if err != nil {
+			// The caller already knows, from the symbol count, how
+			// many symbols remain to decode, so running past the
+			// end of a well-formed stream never happens in practice.
+			b = 0
+		}
+		r.cur = b
+		r.bitsLeft = 8
+	}
+	r.bitsLeft--
+	return uint32((r.cur >> r.bitsLeft) & 1)
+}
+
+// A coefficientStream lazily expands the (run, value) symbols
+// decoded from a plane's Huffman-coded bitstream back into
+// individual quantized coefficients, one at a time, rather than
+// materializing the plane's full coefficient array up front. This
+// lets a Decoder hand a caller one block's coefficients and then
+// forget them.
+type coefficientStream struct {
+	tree *decodeTree
+	br   *bitReader
+
+	remainingSymbols int
+	zerosLeft        int
+	pendingVal       int16
+	valuePending     bool
+
+	total int
+}
+
+// next returns the next quantized coefficient in the plane.
+func (s *coefficientStream) next() int16 {
+	if s.total <= 0 {
+		return 0
+	}
+	s.total--
+	for {
+		if s.zerosLeft > 0 {
+			s.zerosLeft--
+			return 0
+		}
+		if s.valuePending {
+			s.valuePending = false
+			return s.pendingVal
+		}
+		if s.remainingSymbols == 0 {
+			// Trailing zero run left implicit by rleEncode.
+			return 0
+		}
+		sym := s.tree.decode(s.br)
+		s.remainingSymbols--
+		s.zerosLeft = int(sym.Run)
+		s.pendingVal = sym.Val
+		s.valuePending = true
+	}
+}
+
+// nextBlock returns the next n coefficients as a slice.
+func (s *coefficientStream) nextBlock(n int) []int16 {
+	block := make([]int16, n)
+	for i := range block {
+		block[i] = s.next()
+	}
+	return block
+}
+
+// decodeTree is a simple binary trie used to decode Huffman codes
+// bit by bit.
+type decodeTree struct {
+	sym         rleSymbol
+	leaf        bool
+	left, right *decodeTree
+}
+
+func buildDecodeTree(codes map[rleSymbol]huffCode) *decodeTree {
+	root := &decodeTree{}
+	for sym, code := range codes {
+		node := root
+		for i := int(code.Length) - 1; i >= 0; i-- {
+			bit := (code.Bits >> uint(i)) & 1
+			if bit == 0 {
+				if node.left == nil {
+					node.left = &decodeTree{}
+				}
+				node = node.left
+			} else {
+				if node.right == nil {
+					node.right = &decodeTree{}
+				}
+				node = node.right
+			}
+		}
+		node.leaf = true
+		node.sym = sym
+	}
+	return root
+}
+
+func (t *decodeTree) decode(r *bitReader) rleSymbol {
+	node := t
+	for !node.leaf {
+		if r.readBit() == 0 {
+			node = node.left
+		} else {
+			node = node.right
+		}
+	}
+	return node.sym
+}
@@ -0,0 +1,217 @@
+package smallbasis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+// An Orientation is an EXIF orientation tag value (1 through 8),
+// describing how a decoded image's pixels must be flipped and/or
+// rotated to reach their intended display orientation.
+type Orientation byte
+
+const (
+	OrientationNormal         Orientation = 1
+	OrientationFlipHorizontal Orientation = 2
+	OrientationRotate180      Orientation = 3
+	OrientationFlipVertical   Orientation = 4
+	OrientationTranspose      Orientation = 5
+	OrientationRotate90       Orientation = 6
+	OrientationTransverse     Orientation = 7
+	OrientationRotate270      Orientation = 8
+)
+
+// CompressReader decodes raw image bytes (as opposed to an already
+// decoded image.Image) and compresses them, the way Compress does.
+//
+// Unlike Compress, CompressReader looks at the source bytes for an
+// EXIF orientation tag, since most phone cameras write photos in
+// sensor orientation and rely on that tag to display them upright.
+// If c.AutoOrient is true, the detected transform is applied to the
+// pixels before they're split into blocks. Otherwise the transform
+// is only recorded in the compressed header, and Decompress applies
+// it when reconstructing the image. Either way, Decompress returns
+// an upright image.
+func (c *Compressor) CompressReader(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	orientation := readEXIFOrientation(data)
+	var buf bytes.Buffer
+	if c.AutoOrient {
+		err = c.encodeTo(&buf, ApplyOrientation(img, orientation), OrientationNormal)
+	} else {
+		err = c.encodeTo(&buf, img, orientation)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readEXIFOrientation scans a JPEG byte stream for an Exif APP1
+// segment and returns the value of its orientation tag (0x0112).
+// It returns OrientationNormal if the file isn't a JPEG, has no
+// Exif segment, or has no orientation tag.
+func readEXIFOrientation(data []byte) Orientation {
+	r := bytes.NewReader(data)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return OrientationNormal
+	}
+
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil {
+			return OrientationNormal
+		}
+		if marker[0] != 0xFF {
+			return OrientationNormal
+		}
+		// Markers with no payload: standalone and restart markers.
+		if marker[1] == 0x01 || (marker[1] >= 0xD0 && marker[1] <= 0xD9) {
+			continue
+		}
+
+		var segLenBuf [2]byte
+		if _, err := io.ReadFull(r, segLenBuf[:]); err != nil {
+			return OrientationNormal
+		}
+		segLen := int(binary.BigEndian.Uint16(segLenBuf[:])) - 2
+		if segLen < 0 {
+			return OrientationNormal
+		}
+		seg := make([]byte, segLen)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			return OrientationNormal
+		}
+
+		if marker[1] == 0xDA {
+			// Start of scan: no more metadata markers follow.
+			return OrientationNormal
+		}
+		if marker[1] == 0xE1 && len(seg) > 6 && string(seg[:6]) == "Exif\x00\x00" {
+			if o, ok := tiffOrientation(seg[6:]); ok {
+				return o
+			}
+			return OrientationNormal
+		}
+	}
+}
+
+// tiffOrientation parses a TIFF header and its zeroth IFD looking
+// for tag 0x0112 (Orientation).
+func tiffOrientation(tiff []byte) (Orientation, bool) {
+	if len(tiff) < 8 {
+		return 0, false
+	}
+
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 0, false
+	}
+	if bo.Uint16(tiff[2:4]) != 42 {
+		return 0, false
+	}
+
+	ifdOffset := bo.Uint32(tiff[4:8])
+	if int(ifdOffset)+2 > len(tiff) {
+		return 0, false
+	}
+	numEntries := int(bo.Uint16(tiff[ifdOffset : ifdOffset+2]))
+	entriesStart := int(ifdOffset) + 2
+
+	const (
+		tagOrientation = 0x0112
+		typeShort      = 3
+	)
+
+	for i := 0; i < numEntries; i++ {
+		start := entriesStart + i*12
+		if start+12 > len(tiff) {
+			break
+		}
+		entry := tiff[start : start+12]
+		if bo.Uint16(entry[0:2]) != tagOrientation {
+			continue
+		}
+		if bo.Uint16(entry[2:4]) != typeShort {
+			return 0, false
+		}
+		v := bo.Uint16(entry[8:10])
+		if v < 1 || v > 8 {
+			return 0, false
+		}
+		return Orientation(v), true
+	}
+
+	return 0, false
+}
+
+// ApplyOrientation returns a copy of img with the flip/rotation
+// described by o applied, putting its pixels into display
+// orientation. OrientationNormal (and the zero value) are no-ops.
+//
+// Decode applies this automatically using the header's recorded
+// orientation. A caller using Decoder.DecodeBlock directly instead
+// assembles its own image.Image from the decoded blocks (since
+// DecodeBlock never applies orientation itself — see its doc
+// comment), and can call ApplyOrientation on that image using the
+// Decoder's Orientation field.
+func ApplyOrientation(img image.Image, o Orientation) image.Image {
+	if o == OrientationNormal || o == 0 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	outW, outH := w, h
+	if o == OrientationRotate90 || o == OrientationRotate270 ||
+		o == OrientationTranspose || o == OrientationTransverse {
+		outW, outH = h, w
+	}
+
+	res := image.NewRGBA(image.Rect(0, 0, outW, outH))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case OrientationFlipHorizontal:
+				dx, dy = w-1-x, y
+			case OrientationRotate180:
+				dx, dy = w-1-x, h-1-y
+			case OrientationFlipVertical:
+				dx, dy = x, h-1-y
+			case OrientationTranspose:
+				dx, dy = y, x
+			case OrientationRotate90:
+				dx, dy = h-1-y, x
+			case OrientationTransverse:
+				dx, dy = h-1-y, w-1-x
+			case OrientationRotate270:
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+			res.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return res
+}
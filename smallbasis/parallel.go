@@ -0,0 +1,105 @@
+package smallbasis
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// workerCount returns the number of goroutines the Compressor
+// should use for its parallel passes: c.Parallelism if set, or
+// runtime.NumCPU() otherwise.
+func (c *Compressor) workerCount() int {
+	if c.Parallelism > 0 {
+		return c.Parallelism
+	}
+	return runtime.NumCPU()
+}
+
+// parallelRange calls fn(i) for every i in [0, n), spreading the
+// calls across up to workers goroutines. Goroutines pull indices
+// from a shared counter rather than a fixed split, so one slow
+// block doesn't leave the rest of the pool idle.
+func parallelRange(n, workers int, fn func(i int)) {
+	if n == 0 {
+		return
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+	if workers == 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	var next int64
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1) - 1)
+				if i >= n {
+					return
+				}
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// parallelSum shards [0, n) into contiguous ranges, one per
+// worker, and calls reduce(start, end, local) on each range with a
+// worker-local accumulator of length width. The accumulators are
+// then summed elementwise into the returned slice. This is used
+// for associative reductions like the per-basis-vector coefficient
+// totals, where a shared accumulator would need locking.
+func parallelSum(n, workers, width int, reduce func(start, end int, local []float64)) []float64 {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	chunk := ceilDiv(n, workers)
+	partials := make([][]float64, workers)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		start := w * chunk
+		end := start + chunk
+		if end > n {
+			end = n
+		}
+		if start >= end {
+			continue
+		}
+		wg.Add(1)
+		go func(w, start, end int) {
+			defer wg.Done()
+			local := make([]float64, width)
+			reduce(start, end, local)
+			partials[w] = local
+		}(w, start, end)
+	}
+	wg.Wait()
+
+	total := make([]float64, width)
+	for _, local := range partials {
+		for i, v := range local {
+			total[i] += v
+		}
+	}
+	return total
+}
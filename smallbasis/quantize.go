@@ -0,0 +1,42 @@
+package smallbasis
+
+import "math"
+
+// baseQuantStep is the quantizer step used for the highest-energy
+// basis vector (position 0 in a plane's energy-ranked used-basis
+// list) at quality 1. Steps grow linearly with basis position, so
+// lower-ranked basis vectors are quantized more coarsely.
+const baseQuantStep = 1.0 / 256
+
+// quantStep returns the quantizer step for the basis vector at
+// position pos within a plane's used-basis list, at the given
+// quality. Lower quality produces a coarser (larger) step.
+func quantStep(pos int, quality float64) float64 {
+	if quality <= 0 {
+		quality = 1e-6
+	}
+	return baseQuantStep * float64(1+pos) / quality
+}
+
+// quantizeBlock rounds each coefficient in block to the nearest
+// multiple of its position's quantStep and returns the result as
+// int16s.
+func quantizeBlock(block []float64, quality float64) []int16 {
+	res := make([]int16, len(block))
+	for i, coeff := range block {
+		step := quantStep(i, quality)
+		q := math.Floor(coeff/step + 0.5)
+		q = math.Min(math.Max(q, math.MinInt16), math.MaxInt16)
+		res[i] = int16(q)
+	}
+	return res
+}
+
+// dequantizeBlock reverses quantizeBlock.
+func dequantizeBlock(block []int16, quality float64) []float64 {
+	res := make([]float64, len(block))
+	for i, q := range block {
+		res[i] = float64(q) * quantStep(i, quality)
+	}
+	return res
+}
@@ -0,0 +1,88 @@
+package smallbasis
+
+import (
+	"image"
+	"math"
+
+	"github.com/5l1v3r1/imagecompress/resize"
+)
+
+// A ResizeMode controls how Compressor.Resize fits src into the
+// requested width and height when their aspect ratio doesn't match
+// src's.
+type ResizeMode int
+
+const (
+	// ResizeFit scales src to fit entirely inside width x height,
+	// preserving aspect ratio. The result may be smaller than
+	// width x height along one axis.
+	ResizeFit ResizeMode = iota
+
+	// ResizeFill scales src to cover width x height, preserving
+	// aspect ratio, and crops the centered overflow.
+	ResizeFill
+
+	// ResizeExact scales src to width x height exactly, ignoring
+	// its aspect ratio.
+	ResizeExact
+)
+
+// Resize resamples src to width x height according to mode, using
+// a Lanczos3 resampler. Callers who just want to downscale before
+// compressing can use CompressResized instead.
+func (c *Compressor) Resize(src image.Image, width, height int, mode ResizeMode) image.Image {
+	switch mode {
+	case ResizeExact:
+		return resize.Lanczos3(src, width, height)
+	case ResizeFill:
+		return resizeFill(src, width, height)
+	default:
+		return resizeFit(src, width, height)
+	}
+}
+
+// CompressResized resizes src to width x height using mode and
+// then compresses the result, saving a decompress-then-resize
+// round trip for callers who only ever want a thumbnail.
+func (c *Compressor) CompressResized(src image.Image, width, height int, mode ResizeMode) []byte {
+	return c.Compress(c.Resize(src, width, height, mode))
+}
+
+func resizeFit(src image.Image, width, height int) image.Image {
+	b := src.Bounds()
+	srcW, srcH := b.Dx(), b.Dy()
+
+	scale := math.Min(float64(width)/float64(srcW), float64(height)/float64(srcH))
+	fitW := roundFloat(float64(srcW) * scale)
+	fitH := roundFloat(float64(srcH) * scale)
+
+	return resize.Lanczos3(src, fitW, fitH)
+}
+
+func resizeFill(src image.Image, width, height int) image.Image {
+	b := src.Bounds()
+	srcW, srcH := b.Dx(), b.Dy()
+
+	scale := math.Max(float64(width)/float64(srcW), float64(height)/float64(srcH))
+	coverW := roundFloat(float64(srcW) * scale)
+	coverH := roundFloat(float64(srcH) * scale)
+
+	covered := resize.Lanczos3(src, coverW, coverH)
+
+	cropX := (coverW - width) / 2
+	cropY := (coverH - height) / 2
+	return cropImage(covered, cropX, cropY, width, height)
+}
+
+// cropImage extracts a width x height region of img starting at
+// (x, y), copying pixels into a fresh image.RGBA.
+func cropImage(img image.Image, x, y, width, height int) image.Image {
+	res := image.NewRGBA(image.Rect(0, 0, width, height))
+	b := img.Bounds()
+	for row := 0; row < height; row++ {
+		for col := 0; col < width; col++ {
+			res.Set(col, row, img.At(b.Min.X+x+col, b.Min.Y+y+row))
+		}
+	}
+	return res
+}
@@ -0,0 +1,339 @@
+package smallbasis
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"io"
+	"math"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+// EncoderConfig configures a new Encoder. Its fields mirror the
+// corresponding Compressor fields; see their documentation for
+// details.
+type EncoderConfig struct {
+	Quality       float64
+	ChromaQuality float64
+	ColorSpace    ColorSpace
+	BlockSize     int
+	Parallelism   int
+}
+
+// An Encoder writes a single compressed image to an underlying
+// io.Writer as it's produced, rather than building the whole
+// encoded payload in memory and returning it as a []byte the way
+// Compress does. This makes it practical to compress directly onto
+// a gzip.Writer or a network connection.
+//
+// Per-plane coefficients still have to be gathered before the
+// entropy table is written, since canonical Huffman coding needs
+// the full-plane symbol frequencies up front; from that point on,
+// the coded bits are written to the underlying writer one byte at a
+// time as they're produced, never buffered as a second copy of the
+// encoded plane.
+type Encoder struct {
+	w io.Writer
+	c *Compressor
+}
+
+// NewEncoder creates an Encoder that writes to w using cfg.
+func NewEncoder(w io.Writer, cfg EncoderConfig) *Encoder {
+	blockSize := cfg.BlockSize
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+	c := NewCompressorBlockSize(cfg.Quality, blockSize)
+	c.ColorSpace = cfg.ColorSpace
+	c.ChromaQuality = cfg.ChromaQuality
+	c.Parallelism = cfg.Parallelism
+	return &Encoder{w: w, c: c}
+}
+
+// Encode compresses img and streams it to e's writer.
+func (e *Encoder) Encode(img image.Image) error {
+	return e.c.encodeTo(e.w, img, OrientationNormal)
+}
+
+// encodeTo is the shared implementation behind Encoder.Encode and
+// Compressor.Compress/CompressReader: it runs the compression
+// pipeline and writes the result straight to w.
+func (c *Compressor) encodeTo(w io.Writer, i image.Image, orientation Orientation) error {
+	ci := c.compressImage(i, orientation)
+	return ci.writeTo(bufio.NewWriter(w))
+}
+
+// A DecodedBlock is one block's worth of reconstructed pixel
+// samples, as produced by Decoder.DecodeBlock. Pixels is in the
+// same boustrophedon order blocksInPlane uses, and Row/Col locate
+// the block within Plane (one of the color planes recorded in the
+// stream's header, in header order).
+//
+// Row/Col are positions in the stream's stored (sensor) orientation;
+// DecodeBlock never applies Decoder.Orientation, since doing so
+// would also have to remap Row/Col and the plane dimensions for any
+// rotation. A caller that needs an upright image should assemble one
+// from the raw blocks and then call ApplyOrientation on it, passing
+// Decoder.Orientation, the same way Decode does internally.
+type DecodedBlock struct {
+	Plane  int
+	Row    int
+	Col    int
+	Pixels []float64
+}
+
+// planeDecodeState tracks the in-progress decode of a single plane:
+// its basis vectors and quantizer quality, and a coefficientStream
+// pulling symbols lazily from the shared bit reader.
+type planeDecodeState struct {
+	width, height int
+	cols          int
+	quality       float64
+	basisVectors  []linalg.Vector
+	basisCount    int
+	blockCount    int
+	nextBlock     int
+	coeffs        *coefficientStream
+}
+
+// A Decoder reads a single compressed image from an underlying
+// io.Reader, one block at a time, so a caller piping a compressed
+// image in from a socket or gzip.Reader never needs to hold more
+// than one block's coefficients in memory at once. Decode is a
+// convenience wrapper that pulls every block and assembles the
+// final image; since blocks must be decoded in stream order from a
+// single shared bitstream, Decode does so sequentially, on the
+// calling goroutine.
+type Decoder struct {
+	ColorSpace  ColorSpace
+	Orientation Orientation
+	BlockSize   int
+	Width       int
+	Height      int
+
+	r          *bufio.Reader
+	compressor *Compressor
+	planeIdx   int
+	cur        *planeDecodeState
+}
+
+// NewDecoder reads d's header and returns a Decoder ready to decode
+// blocks. It assumes the image was compressed against the default
+// basis for its block size (the same basis NewCompressorBlockSize
+// would build); an image compressed with a custom basis (via
+// NewCompressorBasis) must instead be decoded with that Compressor's
+// own Decompress, since the wire format never stores basis matrices,
+// only indices into one.
+func NewDecoder(r io.Reader) (*Decoder, error) {
+	return newDecoder(r, nil)
+}
+
+// maxStreamBlockSize, maxStreamDimension, and maxStreamPixels are
+// generous sanity bounds on the untrusted blockSize/width/height
+// header fields, checked before they ever reach an allocation.
+// BasisMatrix builds a (blockSize^2)-by-(blockSize^2) matrix, so
+// blockSize alone controls an allocation that grows with the fourth
+// power of its value; width and height each gate a plane-sized
+// make([]float64, ...) in newPlaneData. None of these fields are
+// validated against real plane/basis data until well after the
+// allocations they size already happened, so the bound has to be
+// purely a function of the header value itself.
+const (
+	maxStreamBlockSize = 128
+	maxStreamDimension = 1 << 16
+	maxStreamPixels    = 1 << 28
+)
+
+// newDecoder is the shared implementation behind NewDecoder and
+// Compressor.Decompress. When c is non-nil, its basis and block
+// size are reused (and the stream's block size is validated against
+// it) instead of building a fresh default basis.
+func newDecoder(r io.Reader, c *Compressor) (*Decoder, error) {
+	br := bufio.NewReader(r)
+	er := &errReader{r: br}
+
+	magic := er.readBytes(len(streamMagic))
+	version := er.readByte()
+	colorByte := er.readByte()
+	orientationByte := er.readByte()
+	blockSize := er.readUint32()
+	width := er.readUint32()
+	height := er.readUint32()
+	if er.err != nil {
+		return nil, errors.New("smallbasis: truncated header")
+	}
+	if string(magic) != streamMagic {
+		return nil, errors.New("smallbasis: not a smallbasis compressed image")
+	}
+	if version != streamVersion {
+		return nil, errors.New("smallbasis: unsupported format version")
+	}
+	if blockSize == 0 || blockSize > maxStreamBlockSize {
+		return nil, errors.New("smallbasis: block size exceeds sane bound")
+	}
+	if err := checkStreamDimensions(width, height); err != nil {
+		return nil, err
+	}
+
+	if c != nil && int(blockSize) != c.blockSize {
+		return nil, errors.New("smallbasis: block size mismatch")
+	}
+	if c == nil {
+		c = NewCompressorBlockSize(0, int(blockSize))
+	}
+
+	return &Decoder{
+		ColorSpace:  ColorSpace(colorByte),
+		Orientation: Orientation(orientationByte),
+		BlockSize:   int(blockSize),
+		Width:       int(width),
+		Height:      int(height),
+		r:           br,
+		compressor:  c,
+	}, nil
+}
+
+// DecodeBlock decodes and returns the next block in the stream, or
+// io.EOF once every plane's blocks have been consumed. It does not
+// apply d.Orientation; see DecodedBlock's doc comment for how to
+// orient an image assembled from DecodeBlock's output.
+func (d *Decoder) DecodeBlock() (*DecodedBlock, error) {
+	for d.cur == nil || d.cur.nextBlock >= d.cur.blockCount {
+		if d.planeIdx >= d.ColorSpace.numPlanes() {
+			return nil, io.EOF
+		}
+		if err := d.advancePlane(); err != nil {
+			return nil, err
+		}
+	}
+
+	state := d.cur
+	quant := state.coeffs.nextBlock(state.basisCount)
+	coeffs := dequantizeBlock(quant, state.quality)
+
+	var pixels []float64
+	if len(state.basisVectors) > 0 {
+		pixels = linearCombination(state.basisVectors, coeffs)
+	} else {
+		pixels = make([]float64, d.BlockSize*d.BlockSize)
+	}
+
+	row, col := state.nextBlock/state.cols, state.nextBlock%state.cols
+	state.nextBlock++
+
+	return &DecodedBlock{Plane: d.planeIdx - 1, Row: row, Col: col, Pixels: pixels}, nil
+}
+
+// checkStreamDimensions rejects a width/height pair that's either
+// individually outside maxStreamDimension or whose product (the
+// sample count of the plane it will allocate) exceeds maxStreamPixels.
+func checkStreamDimensions(w, h uint32) error {
+	if w > maxStreamDimension || h > maxStreamDimension {
+		return errors.New("smallbasis: image dimension exceeds sane bound")
+	}
+	if uint64(w)*uint64(h) > maxStreamPixels {
+		return errors.New("smallbasis: image size exceeds sane bound")
+	}
+	return nil
+}
+
+// advancePlane reads the next plane's header (dimensions, quality,
+// used-basis list, and Huffman table) and installs it as d.cur.
+func (d *Decoder) advancePlane() error {
+	er := &errReader{r: d.r}
+
+	pw := er.readUint32()
+	ph := er.readUint32()
+	if er.err == nil {
+		if err := checkStreamDimensions(pw, ph); err != nil {
+			return err
+		}
+	}
+	qualityBits := er.readUint64()
+	basisCount := er.readUint32()
+	if er.err == nil && basisCount > uint32(d.compressor.blockSize*d.compressor.blockSize) {
+		return errors.New("smallbasis: basis count exceeds block size")
+	}
+	usedBasis := make([]int, basisCount)
+	for i := range usedBasis {
+		usedBasis[i] = int(er.readUint32())
+	}
+	blockCount := er.readUint32()
+	if er.err != nil {
+		return errors.New("smallbasis: truncated plane header")
+	}
+
+	for _, x := range usedBasis {
+		if x < 0 || x >= d.compressor.basis.Rows {
+			return errors.New("smallbasis: overflowing basis vector in decoded image")
+		}
+	}
+
+	tree, symbolCount, err := readHuffmanTable(er)
+	if err != nil {
+		return err
+	}
+
+	_, cols := d.compressor.blockCounts(int(pw), int(ph))
+	d.cur = &planeDecodeState{
+		width:        int(pw),
+		height:       int(ph),
+		cols:         cols,
+		quality:      math.Float64frombits(qualityBits),
+		basisVectors: d.compressor.basisVectors(usedBasis),
+		basisCount:   int(basisCount),
+		blockCount:   int(blockCount),
+		coeffs: &coefficientStream{
+			tree:             tree,
+			br:               newBitReader(d.r),
+			remainingSymbols: symbolCount,
+			total:            int(blockCount) * int(basisCount),
+		},
+	}
+	d.planeIdx++
+	return nil
+}
+
+// Decode pulls every remaining block from d and assembles the
+// decoded image, applying the orientation recorded in the header.
+func (d *Decoder) Decode() (image.Image, error) {
+	planes := make([]*planeData, d.ColorSpace.numPlanes())
+
+	for {
+		block, err := d.DecodeBlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if planes[block.Plane] == nil {
+			planes[block.Plane] = newPlaneData(d.cur.width, d.cur.height)
+		}
+		writeBlockToPlane(planes[block.Plane], block, d.BlockSize)
+	}
+
+	img := combinePlanes(d.Width, d.Height, planes, d.ColorSpace)
+	return ApplyOrientation(img, d.Orientation), nil
+}
+
+// writeBlockToPlane copies a decoded block's pixels into their
+// place in p, clamping each sample to [0, 1].
+func writeBlockToPlane(p *planeData, block *DecodedBlock, blockSize int) {
+	for y := 0; y < blockSize; y++ {
+		py := block.Row*blockSize + y
+		if py >= p.Height {
+			continue
+		}
+		for x := 0; x < blockSize; x++ {
+			px := block.Col*blockSize + x
+			if px >= p.Width {
+				continue
+			}
+			v := math.Min(math.Max(block.Pixels[zigzagIndex(x, y, blockSize)], 0), 1)
+			p.set(px, py, v)
+		}
+	}
+}